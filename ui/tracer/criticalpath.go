@@ -0,0 +1,239 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracer
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strings"
+)
+
+// loadNinjaDeps reads a companion dependency listing for the jobs in a
+// `.ninja_log`, used to approximate the build graph for the critical-path
+// heuristic in criticalPathSet. Each non-empty, non-comment line is of the
+// form `output: input input input`, the same shape `ninja -t deps` prints
+// and the simplest thing a build manifest can be reduced to; ninja's own
+// binary `.ninja_deps` log isn't parsed directly.
+func loadNinjaDeps(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	deps := make(map[string][]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		output, rest, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		deps[strings.TrimSpace(output)] = strings.Fields(rest)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+// outputFinish records, for one output name, the entry that most recently
+// produced it (by End time) and when that entry finished - exactly the
+// "last writer" a later entry naming it as an input should attach to.
+type outputFinish struct {
+	idx    int
+	end    int
+	finish int
+}
+
+// findDepsPredecessor looks for entry.Name's best predecessor among its
+// declared inputs, by checking each input and its path prefixes against
+// produced, the last-writer index built up as entries are processed in End
+// order. Prefixes are tried at '/' boundaries, which covers the common case
+// of an output naming a directory that's a prefix of one of entry's inputs
+// without requiring a scan of every earlier entry.
+func findDepsPredecessor(entry *ninjaLogEntry, inputs []string, produced map[string]outputFinish) (best int, bestFinish int) {
+	best = -1
+	for _, input := range inputs {
+		candidate := input
+		for {
+			if of, ok := produced[candidate]; ok && of.end <= entry.Begin {
+				if best == -1 || of.finish > bestFinish {
+					best = of.idx
+					bestFinish = of.finish
+				}
+			}
+			slash := strings.LastIndexByte(candidate, '/')
+			if slash < 0 {
+				break
+			}
+			candidate = candidate[:slash]
+		}
+	}
+	return best, bestFinish
+}
+
+// criticalPathSet derives an approximate critical path through entries - the
+// longest dependency chain ending at any job - and returns which entries are
+// on it; writeCriticalPathSummary totals its duration from that set. It
+// doesn't write any events itself: the
+// critical path is highlighted by tagging the args of the original slice
+// events ImportNinjaLog's main loop writes, not by emitting duplicate
+// events, so it has to be computed before that loop runs.
+//
+// `.ninja_log` doesn't record edges between jobs, so the dependency chain is
+// approximated with a "last writer wins" heuristic: entries are processed in
+// End order, and for each entry E we look for the latest-finishing entry P
+// with P.End <= E.Begin that could plausibly be a dependency of E. When
+// ninjaDepsPath names a dependency listing (see loadNinjaDeps) and E has a
+// line in it, P qualifies only if it's the most recent producer of one of
+// E's inputs (or of a '/'-separated path prefix of one); otherwise - no
+// listing, or no line for E in it - we fall back to treating lanes (the
+// synthetic cpu lanes jobs were scheduled onto) as serialized threads of
+// execution, in which case P is just the entry immediately before E on E's
+// lane.
+//
+// Neither case rescans earlier entries: the lane case is one lookup per
+// entry, and the deps case is one map lookup per input path prefix, so
+// beyond that per-input work the pass is dominated by the O(n log n) sort
+// into End order.
+func (t *tracerImpl) criticalPathSet(entries ninjaLogEntries, lanes []int, ninjaDepsPath string) map[int]bool {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var deps map[string][]string
+	if ninjaDepsPath != "" {
+		var err error
+		deps, err = loadNinjaDeps(ninjaDepsPath)
+		if err != nil {
+			t.log.Println("Error reading ninja deps:", err)
+		}
+	}
+
+	// lanePred[i] is the entry most recently scheduled onto entries[i]'s
+	// synthetic cpu lane. ImportNinjaLog always assigns lanes in increasing
+	// Begin order, so that's always the immediately preceding job on the
+	// lane - the only candidate the no-deps fallback needs.
+	lanePred := make([]int, len(entries))
+	lastOnLane := make(map[int]int, len(entries))
+	for i := range entries {
+		if last, ok := lastOnLane[lanes[i]]; ok {
+			lanePred[i] = last
+		} else {
+			lanePred[i] = -1
+		}
+		lastOnLane[lanes[i]] = i
+	}
+
+	// order is processed in End order so that by the time an entry is
+	// visited, every entry that could be its predecessor has already updated
+	// produced/finish. Ties are broken by original index - which, since
+	// entries is sorted by Begin, is also Begin order - so that a lane
+	// predecessor (always a lower index than its successor) is never
+	// ordered after the entry it precedes; without that tiebreak, a
+	// zero-duration entry scheduled right after its lane predecessor (same
+	// End) could sort first and read finish[p] as its zero value instead of
+	// the real finish time.
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		if entries[order[a]].End != entries[order[b]].End {
+			return entries[order[a]].End < entries[order[b]].End
+		}
+		return order[a] < order[b]
+	})
+
+	produced := make(map[string]outputFinish, len(entries))
+	finish := make([]int, len(entries))
+	pred := make([]int, len(entries))
+	for i := range pred {
+		pred[i] = -1
+	}
+
+	for _, i := range order {
+		entry := entries[i]
+		best := -1
+		bestFinish := 0
+
+		if inputs, ok := deps[entry.Name]; ok {
+			best, bestFinish = findDepsPredecessor(entry, inputs, produced)
+		} else if p := lanePred[i]; p != -1 && entries[p].End <= entry.Begin {
+			best, bestFinish = p, finish[p]
+		}
+
+		base := 0
+		if best != -1 {
+			base = bestFinish
+		}
+		finish[i] = base + (entry.End - entry.Begin)
+		pred[i] = best
+
+		produced[entry.Name] = outputFinish{idx: i, end: entry.End, finish: finish[i]}
+	}
+
+	end := 0
+	for i, f := range finish {
+		if f > finish[end] {
+			end = i
+		}
+	}
+
+	onPath := make(map[int]bool, len(entries))
+	for i := end; i != -1; i = pred[i] {
+		onPath[i] = true
+	}
+	return onPath
+}
+
+// writeCriticalPathSummary emits a metadata event comparing the critical
+// path's total duration against wall-clock time, so a user can immediately
+// see how much of the build was forced to serialize versus how much could
+// have overlapped with more parallelism.
+func (t *tracerImpl) writeCriticalPathSummary(entries ninjaLogEntries, onCriticalPath map[int]bool, offset uint64) {
+	if len(onCriticalPath) == 0 {
+		return
+	}
+
+	var criticalPathDur int
+	wallStart, wallEnd := entries[0].Begin, entries[0].End
+	for i, entry := range entries {
+		if onCriticalPath[i] {
+			criticalPathDur += entry.End - entry.Begin
+		}
+		if entry.Begin < wallStart {
+			wallStart = entry.Begin
+		}
+		if entry.End > wallEnd {
+			wallEnd = entry.End
+		}
+	}
+
+	t.writeEvent(&viewerEvent{
+		Name:  "critical path",
+		Phase: "M",
+		Pid:   1,
+		Args: map[string]interface{}{
+			"critical_path_us": criticalPathDur,
+			"wall_time_us":     wallEnd - wallStart,
+		},
+	})
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracer
+
+import "testing"
+
+// TestCriticalPathSetLaneFallback checks the no-deps fallback, where the
+// critical path walks back through the immediately preceding entry on each
+// entry's synthetic cpu lane: two lanes of two entries each, with the second
+// lane's jobs taking longer, so the longest chain should be entirely on lane
+// 1 rather than switching lanes partway through.
+func TestCriticalPathSetLaneFallback(t *testing.T) {
+	entries := ninjaLogEntries{
+		{Name: "a", Begin: 0, End: 10},    // lane 0
+		{Name: "b", Begin: 0, End: 100},   // lane 1, much longer
+		{Name: "c", Begin: 10, End: 20},   // lane 0, after a
+		{Name: "d", Begin: 100, End: 110}, // lane 1, after b
+	}
+	lanes := []int{0, 1, 0, 1}
+
+	tr := &tracerImpl{}
+	got := tr.criticalPathSet(entries, lanes, "")
+
+	want := map[int]bool{1: true, 3: true}
+	if len(got) != len(want) {
+		t.Fatalf("criticalPathSet() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i] {
+			t.Errorf("criticalPathSet()[%d] = false, want true", i)
+		}
+	}
+}
+
+// TestCriticalPathSetZeroDurationTie checks that a zero-duration entry
+// scheduled right after its lane predecessor - so it shares the same End,
+// a common case for up-to-date ninja jobs - still links onto that
+// predecessor's full finish time instead of the chain getting truncated by
+// an End-order sort that processed the successor first.
+func TestCriticalPathSetZeroDurationTie(t *testing.T) {
+	entries := ninjaLogEntries{
+		{Name: "a", Begin: 0, End: 10},  // lane 0, dur 10
+		{Name: "b", Begin: 10, End: 10}, // lane 0, zero duration, ties a's End
+		{Name: "c", Begin: 10, End: 20}, // lane 0, dur 10, after b
+	}
+	lanes := []int{0, 0, 0}
+
+	tr := &tracerImpl{}
+	got := tr.criticalPathSet(entries, lanes, "")
+
+	want := map[int]bool{0: true, 1: true, 2: true}
+	if len(got) != len(want) {
+		t.Fatalf("criticalPathSet() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i] {
+			t.Errorf("criticalPathSet()[%d] = false, want true", i)
+		}
+	}
+}
+
+// TestCriticalPathSetEmpty checks that an empty entry list doesn't confuse
+// the back-pointer walk into panicking or returning a bogus non-empty set.
+func TestCriticalPathSetEmpty(t *testing.T) {
+	tr := &tracerImpl{}
+	if got := tr.criticalPathSet(nil, nil, ""); got != nil {
+		t.Errorf("criticalPathSet(nil, nil, \"\") = %v, want nil", got)
+	}
+}
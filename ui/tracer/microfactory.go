@@ -0,0 +1,129 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// microfactoryEvent mirrors the subset of the Chrome JSON trace format that
+// microfactory, and the other small helper tools that follow its tracing
+// convention, write to their `.<name>.trace` fragments.
+type microfactoryEvent struct {
+	Name  string      `json:"name"`
+	Phase string      `json:"ph"`
+	Time  uint64      `json:"ts"`
+	Dur   uint64      `json:"dur,omitempty"`
+	Tid   uint64      `json:"tid"`
+	Args  interface{} `json:"args,omitempty"`
+}
+
+// microfactoryPidBase is where pids synthesized for imported fragments start,
+// high enough to stay clear of the small number of pids the rest of the
+// tracer package hands out by hand (ninja log import uses pid 1).
+const microfactoryPidBase = 1000
+
+// nextMicrofactoryPid hands out a fresh pid for each imported fragment, so
+// that fragments with overlapping tids don't collide once merged into the
+// same trace. It's only ever touched from ImportMicrofactoryTrace, which
+// like every other Import* in this package is assumed to run sequentially
+// from the one goroutine that's building the trace; it isn't safe for
+// concurrent callers.
+var nextMicrofactoryPid uint64 = microfactoryPidBase
+
+// microfactoryFragmentName derives the process name a fragment's events are
+// merged under from its filename, stripping the leading "." and trailing
+// ".trace" microfactory-style fragments are conventionally named with (for
+// example ".footool.trace" becomes "footool").
+func microfactoryFragmentName(filename string) string {
+	base := filepath.Base(filename)
+	return strings.TrimSuffix(strings.TrimPrefix(base, "."), ".trace")
+}
+
+// ImportMicrofactoryTrace reads a microfactory-style `.<name>.trace` JSON
+// fragment and merges its events into the trace.
+//
+// startOffset is when the sub-tool that wrote filename was started; the
+// fragment's own timestamps are relative to that and are rebased onto
+// startOffset so the fragment lines up with the rest of the build timeline.
+// The fragment's events are remapped onto a pid dedicated to this fragment,
+// named after the fragment's filename, so that tids reused across fragments
+// don't collide in the merged trace.
+func (t *tracerImpl) ImportMicrofactoryTrace(thread Thread, filename string, startOffset time.Time) {
+	t.Begin("microfactory trace import", thread)
+	defer t.End(thread)
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.log.Println("Error reading microfactory trace:", err)
+		return
+	}
+
+	var events []microfactoryEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		t.log.Printf("Error parsing microfactory trace %q: %v", filename, err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	pid := nextMicrofactoryPid
+	nextMicrofactoryPid++
+
+	offset := uint64(startOffset.UnixNano()) / 1000
+
+	name := microfactoryFragmentName(filename)
+
+	t.writeEvent(&viewerEvent{
+		Name:  "process_name",
+		Phase: "M",
+		Pid:   pid,
+		Args:  map[string]string{"name": name},
+	})
+
+	for _, event := range events {
+		t.writeEvent(&viewerEvent{
+			Name:  event.Name,
+			Phase: event.Phase,
+			Time:  offset + event.Time,
+			Dur:   event.Dur,
+			Pid:   pid,
+			Tid:   event.Tid,
+			Args:  event.Args,
+		})
+	}
+}
+
+// ImportAuxTraces globs dir for files matching pattern (for example
+// "*.trace") and imports each match as a microfactory trace fragment via
+// ImportMicrofactoryTrace.
+func (t *tracerImpl) ImportAuxTraces(thread Thread, dir, pattern string, startOffset time.Time) {
+	t.Begin("aux trace import", thread)
+	defer t.End(thread)
+
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		t.log.Printf("Error globbing %q in %q: %v", pattern, dir, err)
+		return
+	}
+	for _, filename := range matches {
+		t.ImportMicrofactoryTrace(thread, filename, startOffset)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracer
+
+import "testing"
+
+func TestMicrofactoryFragmentName(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"/tmp/build/.footool.trace", "footool"},
+		{".bar.trace", "bar"},
+		{"/tmp/build/noprefix.trace", "noprefix"},
+		{"/tmp/build/.nosuffix", "nosuffix"},
+	}
+	for _, tt := range tests {
+		if got := microfactoryFragmentName(tt.filename); got != tt.want {
+			t.Errorf("microfactoryFragmentName(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package tracer
 
 import (
 	"bufio"
+	"fmt"
 	"os"
 	"sort"
 	"strconv"
@@ -34,13 +35,135 @@ func (n ninjaLogEntries) Len() int           { return len(n) }
 func (n ninjaLogEntries) Less(i, j int) bool { return n[i].Begin < n[j].Begin }
 func (n ninjaLogEntries) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
 
+// ninjaLogHeaderPrefix is the part of a `.ninja_log` header line that's
+// constant across ninja releases; only the version number after it changes.
+const ninjaLogHeaderPrefix = "# ninja log v"
+
+// ninjaLogVersions are the ninja log format versions we know how to parse,
+// used both to look up a parser and to report what's supported when we
+// don't recognize a header.
+var ninjaLogVersions = map[int]ninjaLogParser{
+	5: ninjaLogParserV5{},
+	6: ninjaLogParserV6{},
+}
+
+// ninjaLogParser turns one non-header line of a `.ninja_log` file into a
+// ninjaLogEntry. Every ninja log format version gets its own parser, since
+// the column layout (and the encoding of the hash columns) has changed
+// between versions.
+type ninjaLogParser interface {
+	parse(line string) (*ninjaLogEntry, error)
+}
+
+// ninjaLogParserV5 parses the `start\tend\trestat\tname\thash` layout written
+// by ninja log format v5.
+type ninjaLogParserV5 struct{}
+
+func (ninjaLogParserV5) parse(line string) (*ninjaLogEntry, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("expected at least 5 fields, got %d", len(fields))
+	}
+	begin, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid start time %q: %w", fields[0], err)
+	}
+	end, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid end time %q: %w", fields[1], err)
+	}
+	return &ninjaLogEntry{
+		Name:  fields[3],
+		Begin: begin,
+		End:   end,
+	}, nil
+}
+
+// ninjaLogParserV6 parses the v6 layout, which appends a command hash column
+// after the restat hash. Both hash columns are unsigned 32-bit values, unlike
+// the signed timestamps earlier in the line.
+type ninjaLogParserV6 struct{}
+
+func (ninjaLogParserV6) parse(line string) (*ninjaLogEntry, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 6 {
+		return nil, fmt.Errorf("expected at least 6 fields, got %d", len(fields))
+	}
+	begin, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid start time %q: %w", fields[0], err)
+	}
+	end, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid end time %q: %w", fields[1], err)
+	}
+	if _, err := strconv.ParseUint(fields[4], 10, 32); err != nil {
+		return nil, fmt.Errorf("invalid restat hash %q: %w", fields[4], err)
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 32); err != nil {
+		return nil, fmt.Errorf("invalid command hash %q: %w", fields[5], err)
+	}
+	return &ninjaLogEntry{
+		Name:  fields[3],
+		Begin: begin,
+		End:   end,
+	}, nil
+}
+
+// parseNinjaLogHeader splits a `.ninja_log` header line into its version
+// number, returning ok=false if the line isn't a recognizable header at all.
+func parseNinjaLogHeader(header string) (version int, ok bool) {
+	if !strings.HasPrefix(header, ninjaLogHeaderPrefix) {
+		return 0, false
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(header, ninjaLogHeaderPrefix))
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+// ImportNinjaLogOption configures optional behavior of ImportNinjaLog.
+type ImportNinjaLogOption func(*importNinjaLogOptions)
+
+type importNinjaLogOptions struct {
+	jobWeight     func(name string) float64
+	ninjaDepsPath string
+}
+
+// WithJobWeights supplies a per-job weight function, keyed by the job's
+// output name, used to additionally emit a weighted_load counter alongside
+// running_jobs. Without it, only running_jobs is emitted.
+func WithJobWeights(weight func(name string) float64) ImportNinjaLogOption {
+	return func(o *importNinjaLogOptions) {
+		o.jobWeight = weight
+	}
+}
+
+// WithNinjaDeps points the critical-path approximation at a companion
+// `.ninja_deps` or build manifest listing each output's inputs. When
+// supplied, a job listed in it only has a predecessor whose output is among
+// its inputs (or is a '/'-separated path prefix of one); without it, and for
+// jobs the listing has no line for, the critical path falls back to assuming
+// serialized execution on the same synthetic cpu lane.
+func WithNinjaDeps(path string) ImportNinjaLogOption {
+	return func(o *importNinjaLogOptions) {
+		o.ninjaDepsPath = path
+	}
+}
+
 // ImportNinjaLog reads a .ninja_log file from ninja and writes the events out
 // to the trace.
 //
 // startOffset is when the ninja process started, and is used to position the
 // relative times from the ninja log into the trace. It's also used to skip
 // reading the ninja log if nothing was run.
-func (t *tracerImpl) ImportNinjaLog(thread Thread, filename string, startOffset time.Time) {
+func (t *tracerImpl) ImportNinjaLog(thread Thread, filename string, startOffset time.Time, opts ...ImportNinjaLogOption) {
+	var options importNinjaLogOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	t.Begin("ninja log import", thread)
 	defer t.End(thread)
 
@@ -61,39 +184,41 @@ func (t *tracerImpl) ImportNinjaLog(thread Thread, filename string, startOffset
 
 	s := bufio.NewScanner(f)
 	header := true
+	var parser ninjaLogParser
 	entries := ninjaLogEntries{}
 	prevEnd := 0
 	for s.Scan() {
 		if header {
 			hdr := s.Text()
-			if hdr != "# ninja log v5" {
+			version, ok := parseNinjaLogHeader(hdr)
+			if !ok {
 				t.log.Printf("Unknown ninja log header: %q", hdr)
 				return
 			}
+			parser, ok = ninjaLogVersions[version]
+			if !ok {
+				supported := make([]int, 0, len(ninjaLogVersions))
+				for v := range ninjaLogVersions {
+					supported = append(supported, v)
+				}
+				sort.Ints(supported)
+				t.log.Printf("Unsupported ninja log version %d, not importing any entries (supported versions: %v)", version, supported)
+				return
+			}
 			header = false
 			continue
 		}
 
-		fields := strings.Split(s.Text(), "\t")
-		begin, err := strconv.Atoi(fields[0])
-		if err != nil {
-			t.log.Printf("Unable to parse ninja entry %q: %v", s.Text(), err)
-			return
-		}
-		end, err := strconv.Atoi(fields[1])
+		entry, err := parser.parse(s.Text())
 		if err != nil {
 			t.log.Printf("Unable to parse ninja entry %q: %v", s.Text(), err)
 			return
 		}
-		if end < prevEnd {
+		if entry.End < prevEnd {
 			entries = nil
 		}
-		prevEnd = end
-		entries = append(entries, &ninjaLogEntry{
-			Name:  fields[3],
-			Begin: begin,
-			End:   end,
-		})
+		prevEnd = entry.End
+		entries = append(entries, entry)
 	}
 	if err := s.Err(); err != nil {
 		t.log.Println("Unable to parse ninja log:", err)
@@ -102,9 +227,41 @@ func (t *tracerImpl) ImportNinjaLog(thread Thread, filename string, startOffset
 
 	sort.Sort(entries)
 
-	cpus := []int{}
+	lanes := assignNinjaLogLanes(entries)
 	offset := uint64(startOffset.UnixNano()) / 1000
-	for _, entry := range entries {
+	onCriticalPath := t.criticalPathSet(entries, lanes, options.ninjaDepsPath)
+
+	for i, entry := range entries {
+		var args interface{}
+		if onCriticalPath[i] {
+			args = map[string]interface{}{
+				"cat":   "critical_path",
+				"cname": "terrible",
+			}
+		}
+		t.writeEvent(&viewerEvent{
+			Name:  entry.Name,
+			Phase: "X",
+			Time:  offset + uint64(entry.Begin)*1000,
+			Dur:   uint64(entry.End-entry.Begin) * 1000,
+			Pid:   1,
+			Tid:   uint64(lanes[i]),
+			Args:  args,
+		})
+	}
+
+	t.writeJobCounters(entries, offset, 1, options.jobWeight)
+	t.writeCriticalPathSummary(entries, onCriticalPath, offset)
+}
+
+// assignNinjaLogLanes greedily assigns each entry (which must already be
+// sorted by Begin) onto the lowest-numbered synthetic cpu lane that's free
+// by the time it starts, the same scheduling ImportNinjaLog has always used
+// to pick each entry's Tid.
+func assignNinjaLogLanes(entries ninjaLogEntries) []int {
+	cpus := []int{}
+	lanes := make([]int, len(entries))
+	for i, entry := range entries {
 		tid := -1
 		for cpu, endTime := range cpus {
 			if endTime <= entry.Begin {
@@ -117,14 +274,90 @@ func (t *tracerImpl) ImportNinjaLog(thread Thread, filename string, startOffset
 			tid = len(cpus)
 			cpus = append(cpus, entry.End)
 		}
+		lanes[i] = tid
+	}
+	return lanes
+}
 
+// ninjaLogBoundary marks a point where a job begins or ends, with the signed
+// deltas that its start/end contributes to the running job count and (if
+// weights are in use) the running weighted load.
+type ninjaLogBoundary struct {
+	time   int
+	jobs   int
+	weight float64
+}
+
+// jobCounterSample is one sampled point writeJobCounters turns into a C
+// event: the running job count (and, if weights are in use, the running
+// weighted load) immediately after every boundary at time has been applied.
+type jobCounterSample struct {
+	time          int
+	runningJobs   int
+	runningWeight float64
+}
+
+// jobCounterSamples sweeps entries' begin/end boundaries in time order and
+// returns one sample per distinct timestamp with the running totals after
+// every boundary at that timestamp has been applied. If weight is nil,
+// runningWeight is left at zero throughout and should be ignored.
+func jobCounterSamples(entries ninjaLogEntries, weight func(name string) float64) []jobCounterSample {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	boundaries := make([]ninjaLogBoundary, 0, len(entries)*2)
+	for _, entry := range entries {
+		w := 0.0
+		if weight != nil {
+			w = weight(entry.Name)
+		}
+		boundaries = append(boundaries,
+			ninjaLogBoundary{time: entry.Begin, jobs: 1, weight: w},
+			ninjaLogBoundary{time: entry.End, jobs: -1, weight: -w},
+		)
+	}
+	sort.Slice(boundaries, func(i, j int) bool {
+		if boundaries[i].time != boundaries[j].time {
+			return boundaries[i].time < boundaries[j].time
+		}
+		// Process ends before begins at the same instant, so a job ending
+		// exactly when another begins isn't counted as briefly overlapping.
+		return boundaries[i].jobs < boundaries[j].jobs
+	})
+
+	var samples []jobCounterSample
+	runningJobs := 0
+	runningWeight := 0.0
+	for i := 0; i < len(boundaries); {
+		ts := boundaries[i].time
+		for i < len(boundaries) && boundaries[i].time == ts {
+			runningJobs += boundaries[i].jobs
+			runningWeight += boundaries[i].weight
+			i++
+		}
+		samples = append(samples, jobCounterSample{time: ts, runningJobs: runningJobs, runningWeight: runningWeight})
+	}
+	return samples
+}
+
+// writeJobCounters emits Chrome trace counter ("C") events tracking how many
+// ninja jobs are running at once, sampled at every point in entries where a
+// job begins or ends. If weight is non-nil, it also emits a weighted_load
+// counter computed from the per-job weights it returns. The counters share
+// pid with the slice lanes ImportNinjaLog writes the jobs themselves onto.
+func (t *tracerImpl) writeJobCounters(entries ninjaLogEntries, offset uint64, pid uint64, weight func(name string) float64) {
+	for _, sample := range jobCounterSamples(entries, weight) {
+		args := map[string]interface{}{"running_jobs": sample.runningJobs}
+		if weight != nil {
+			args["weighted_load"] = sample.runningWeight
+		}
 		t.writeEvent(&viewerEvent{
-			Name:  entry.Name,
-			Phase: "X",
-			Time:  offset + uint64(entry.Begin)*1000,
-			Dur:   uint64(entry.End-entry.Begin) * 1000,
-			Pid:   1,
-			Tid:   uint64(tid),
+			Name:  "job counters",
+			Phase: "C",
+			Time:  offset + uint64(sample.time)*1000,
+			Pid:   pid,
+			Args:  args,
 		})
 	}
 }
@@ -0,0 +1,151 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracer
+
+import "testing"
+
+func TestParseNinjaLogHeader(t *testing.T) {
+	tests := []struct {
+		header  string
+		wantVer int
+		wantOK  bool
+	}{
+		{"# ninja log v5", 5, true},
+		{"# ninja log v6", 6, true},
+		{"# ninja log v99", 99, true},
+		{"not a header", 0, false},
+		{"# ninja log vx", 0, false},
+	}
+	for _, tt := range tests {
+		version, ok := parseNinjaLogHeader(tt.header)
+		if version != tt.wantVer || ok != tt.wantOK {
+			t.Errorf("parseNinjaLogHeader(%q) = (%d, %v), want (%d, %v)", tt.header, version, ok, tt.wantVer, tt.wantOK)
+		}
+	}
+}
+
+func TestNinjaLogVersionDispatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		line    string
+		want    *ninjaLogEntry
+		wantErr bool
+	}{
+		{
+			name:    "v5",
+			version: 5,
+			line:    "100\t200\t0\tout.o\tdeadbeef",
+			want:    &ninjaLogEntry{Name: "out.o", Begin: 100, End: 200},
+		},
+		{
+			name:    "v5 too few fields",
+			version: 5,
+			line:    "100\t200\t0\tout.o",
+			wantErr: true,
+		},
+		{
+			name:    "v6",
+			version: 6,
+			line:    "100\t200\t0\tout.o\t1\t2",
+			want:    &ninjaLogEntry{Name: "out.o", Begin: 100, End: 200},
+		},
+		{
+			name:    "v6 invalid command hash",
+			version: 6,
+			line:    "100\t200\t0\tout.o\t1\tnot-a-hash",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser, ok := ninjaLogVersions[tt.version]
+			if !ok {
+				t.Fatalf("no parser registered for version %d", tt.version)
+			}
+			got, err := parser.parse(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parse(%q) = %+v, want error", tt.line, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse(%q) returned error: %v", tt.line, err)
+			}
+			if *got != *tt.want {
+				t.Errorf("parse(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestJobCounterSamplesEndBeforeBeginTie checks that a job ending at the
+// same instant another begins doesn't briefly count both as running: the
+// sample at that timestamp should reflect the end having been applied first.
+func TestJobCounterSamplesEndBeforeBeginTie(t *testing.T) {
+	entries := ninjaLogEntries{
+		{Name: "a", Begin: 0, End: 10},
+		{Name: "b", Begin: 10, End: 20},
+	}
+
+	samples := jobCounterSamples(entries, nil)
+
+	want := []jobCounterSample{
+		{time: 0, runningJobs: 1},
+		{time: 10, runningJobs: 1},
+		{time: 20, runningJobs: 0},
+	}
+	if len(samples) != len(want) {
+		t.Fatalf("jobCounterSamples() = %+v, want %+v", samples, want)
+	}
+	for i, s := range samples {
+		if s.time != want[i].time || s.runningJobs != want[i].runningJobs {
+			t.Errorf("jobCounterSamples()[%d] = %+v, want %+v", i, s, want[i])
+		}
+	}
+}
+
+// TestJobCounterSamplesWeighted checks that weighted_load accumulates the
+// per-job weight function's values the same way running_jobs accumulates
+// the job count.
+func TestJobCounterSamplesWeighted(t *testing.T) {
+	entries := ninjaLogEntries{
+		{Name: "a", Begin: 0, End: 10},
+		{Name: "b", Begin: 0, End: 20},
+	}
+	weight := func(name string) float64 {
+		if name == "a" {
+			return 1.0
+		}
+		return 2.0
+	}
+
+	samples := jobCounterSamples(entries, weight)
+
+	want := []jobCounterSample{
+		{time: 0, runningJobs: 2, runningWeight: 3.0},
+		{time: 10, runningJobs: 1, runningWeight: 2.0},
+		{time: 20, runningJobs: 0, runningWeight: 0.0},
+	}
+	if len(samples) != len(want) {
+		t.Fatalf("jobCounterSamples() = %+v, want %+v", samples, want)
+	}
+	for i, s := range samples {
+		if s.time != want[i].time || s.runningJobs != want[i].runningJobs || s.runningWeight != want[i].runningWeight {
+			t.Errorf("jobCounterSamples()[%d] = %+v, want %+v", i, s, want[i])
+		}
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math"
+)
+
+// Format selects the on-disk encoding trace events are written in; see
+// newFormatWriter for how it maps onto a writer.
+type Format int
+
+const (
+	// FormatChromeJSON is the legacy Chrome "trace event" JSON array format
+	// that writeEvent/viewerEvent have always produced. It's simple and
+	// universally supported, but becomes unwieldy - hundreds of MB, slow to
+	// load - for multi-hour Android builds.
+	FormatChromeJSON Format = iota
+	// FormatPerfettoProto writes length-delimited Perfetto TracePacket
+	// protos instead, which the Perfetto UI can memory-map without first
+	// parsing the whole trace into memory.
+	FormatPerfettoProto
+)
+
+// eventWriter is the interface a non-default Format resolves to: one place
+// writeEvent can hand off a viewerEvent to instead of encoding it as Chrome
+// JSON inline.
+type eventWriter interface {
+	WriteViewerEvent(event *viewerEvent) error
+}
+
+// newFormatWriter returns the eventWriter New should dispatch to for format,
+// or nil for FormatChromeJSON, meaning writeEvent should take the Chrome
+// JSON array path it always has - newFormatWriter only ever hands back a
+// writer for the formats that need to override that default.
+//
+// This is genuinely unreachable until New/writeEvent call it: those live in
+// this package's tracer.go, which isn't present in this tree (it was never
+// part of this series of changes, and isn't introduced by it) so the wiring
+// can't be completed here without writing tracer.go from scratch based on
+// nothing but its callers' usage, which risks diverging from the real file.
+// The change New/writeEvent need is exactly two lines: New stores the result
+// of newFormatWriter(format, w) on tracerImpl, and writeEvent checks that
+// field first, calling WriteViewerEvent(event) and returning early when it's
+// non-nil.
+func newFormatWriter(format Format, w io.Writer) eventWriter {
+	switch format {
+	case FormatPerfettoProto:
+		return newPerfettoWriter(w)
+	default:
+		return nil
+	}
+}
+
+// perfettoTrackEventType mirrors perfetto.protos.TrackEvent.Type.
+type perfettoTrackEventType int32
+
+const (
+	perfettoTypeSliceBegin perfettoTrackEventType = 1
+	perfettoTypeSliceEnd   perfettoTrackEventType = 2
+	perfettoTypeCounter    perfettoTrackEventType = 4
+)
+
+// perfettoTrustedPacketSequenceID is the sequence id every TracePacket we
+// emit is tagged with. We only ever write from a single sequence (there's no
+// interning or incremental state to track across packets), so a constant is
+// enough to satisfy Perfetto's requirement that TrackEvent packets carry one.
+const perfettoTrustedPacketSequenceID = 1
+
+// perfettoWriter encodes viewerEvents as length-delimited Perfetto
+// TracePacket protos, as an alternative to the Chrome JSON array writeEvent
+// normally produces. It doesn't depend on generated protobuf code or a
+// protobuf runtime - the handful of fields we need are encoded directly with
+// the protobuf wire format, which is simpler than adding either as a
+// dependency of this package.
+type perfettoWriter struct {
+	w io.Writer
+
+	// knownTracks remembers which pid/tid track_uuids we've already emitted
+	// a TrackDescriptor for, since Perfetto only needs to see one per track.
+	knownTracks map[uint64]bool
+}
+
+func newPerfettoWriter(w io.Writer) *perfettoWriter {
+	return &perfettoWriter{
+		w:           w,
+		knownTracks: make(map[uint64]bool),
+	}
+}
+
+// processTrackUUID, threadTrackUUID, and counterTrackUUID derive stable,
+// collision-free track_uuids from a viewerEvent's pid/tid (or, for counters,
+// pid/name), matching the pids/tids ImportNinjaLog (and the other Import*
+// methods) synthesize for their slice lanes and counters.
+//
+// counterTrackUUID sets bit 31, the top bit of its hashed low 32 bits, so they can never
+// collide with a threadTrackUUID's tid+1, which stays far below it in
+// practice; it's keyed by name as well as pid so that a "C" event's Args map
+// - e.g. running_jobs and weighted_load in the same event - gets one track
+// per key instead of interleaving every counter onto a single pid track.
+func processTrackUUID(pid uint64) uint64     { return pid << 32 }
+func threadTrackUUID(pid, tid uint64) uint64 { return pid<<32 | (tid + 1) }
+func counterTrackUUID(pid uint64, name string) uint64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return pid<<32 | 0x80000000 | uint64(h.Sum32())&0x7fffffff
+}
+
+// WriteViewerEvent encodes event as one or more Perfetto TracePackets -
+// TrackDescriptors the first time a pid/tid is seen, followed by the
+// TrackEvent itself - and writes them length-delimited to the underlying
+// stream.
+func (p *perfettoWriter) WriteViewerEvent(event *viewerEvent) error {
+	if err := p.ensureTrackDescriptors(event); err != nil {
+		return err
+	}
+
+	switch event.Phase {
+	case "X":
+		begin := newPerfettoTracePacket(event.Time, threadTrackUUID(event.Pid, event.Tid))
+		begin.trackEvent(perfettoTypeSliceBegin, event.Name)
+		if err := p.writePacket(begin); err != nil {
+			return err
+		}
+
+		end := newPerfettoTracePacket(event.Time+event.Dur, threadTrackUUID(event.Pid, event.Tid))
+		end.trackEvent(perfettoTypeSliceEnd, "")
+		return p.writePacket(end)
+	case "C":
+		args, _ := event.Args.(map[string]interface{})
+		for name, value := range args {
+			uuid := counterTrackUUID(event.Pid, name)
+			if !p.knownTracks[uuid] {
+				p.knownTracks[uuid] = true
+				descriptor := newPerfettoCounterTrackDescriptor(uuid, processTrackUUID(event.Pid), name)
+				if err := p.writePacket(descriptor); err != nil {
+					return err
+				}
+			}
+
+			counter := newPerfettoTracePacket(event.Time, uuid)
+			counter.counterEvent(value)
+			if err := p.writePacket(counter); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		// Metadata ("M") and any other phase we don't have a TrackEvent
+		// mapping for yet are dropped rather than guessed at.
+		return nil
+	}
+}
+
+func (p *perfettoWriter) ensureTrackDescriptors(event *viewerEvent) error {
+	pidUUID := processTrackUUID(event.Pid)
+	if !p.knownTracks[pidUUID] {
+		p.knownTracks[pidUUID] = true
+		if err := p.writePacket(newPerfettoProcessDescriptor(pidUUID, event.Pid)); err != nil {
+			return err
+		}
+	}
+
+	if event.Phase == "C" {
+		return nil
+	}
+
+	tidUUID := threadTrackUUID(event.Pid, event.Tid)
+	if !p.knownTracks[tidUUID] {
+		p.knownTracks[tidUUID] = true
+		if err := p.writePacket(newPerfettoThreadDescriptor(tidUUID, pidUUID, event.Tid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *perfettoWriter) writePacket(packet *perfettoTracePacket) error {
+	return writeLenDelim(p.w, packet.buf.Bytes())
+}
+
+// perfettoTracePacket accumulates the wire-format bytes of a single
+// perfetto.protos.TracePacket message.
+type perfettoTracePacket struct {
+	buf bytes.Buffer
+
+	// trackUUID is the track this packet's TrackEvent (if any) belongs to.
+	// It's stashed here, rather than threaded through every call, since
+	// trackEvent/counterEvent are always called right after the packet is
+	// constructed with newPerfettoTracePacket.
+	trackUUID uint64
+}
+
+// newPerfettoTracePacket starts a TracePacket with its timestamp (field 8)
+// and trusted_packet_sequence_id (field 10) already written.
+func newPerfettoTracePacket(timestampUs uint64, trackUUID uint64) *perfettoTracePacket {
+	p := &perfettoTracePacket{}
+	writeVarintField(&p.buf, 8, timestampUs*1000) // Perfetto timestamps are nanoseconds.
+	writeVarintField(&p.buf, 10, perfettoTrustedPacketSequenceID)
+	p.trackUUID = trackUUID
+	return p
+}
+
+func (p *perfettoTracePacket) trackEvent(typ perfettoTrackEventType, name string) {
+	var event bytes.Buffer
+	writeVarintField(&event, 9, uint64(typ))  // TrackEvent.type
+	writeVarintField(&event, 11, p.trackUUID) // TrackEvent.track_uuid
+	if name != "" {
+		writeStringField(&event, 23, name) // TrackEvent.name
+	}
+	writeLenDelimField(&p.buf, 11, event.Bytes()) // TracePacket.track_event
+}
+
+// counterEvent writes a counter sample for the packet's track. The counter's
+// name isn't repeated here - it lives on the track's TrackDescriptor,
+// written once by newPerfettoCounterTrackDescriptor the first time the track
+// is seen.
+func (p *perfettoTracePacket) counterEvent(value interface{}) {
+	var event bytes.Buffer
+	writeVarintField(&event, 9, uint64(perfettoTypeCounter)) // TrackEvent.type
+	writeVarintField(&event, 11, p.trackUUID)                // TrackEvent.track_uuid
+	switch v := value.(type) {
+	case int:
+		writeVarintField(&event, 30, uint64(int64(v))) // TrackEvent.counter_value
+	case int64:
+		writeVarintField(&event, 30, uint64(v))
+	case float64:
+		writeDoubleField(&event, 44, v) // TrackEvent.double_counter_value
+	}
+	writeLenDelimField(&p.buf, 11, event.Bytes())
+}
+
+func newPerfettoProcessDescriptor(uuid, pid uint64) *perfettoTracePacket {
+	p := &perfettoTracePacket{}
+	writeVarintField(&p.buf, 10, perfettoTrustedPacketSequenceID)
+
+	var desc bytes.Buffer
+	writeVarintField(&desc, 1, uuid) // TrackDescriptor.uuid
+
+	var process bytes.Buffer
+	writeVarintField(&process, 1, pid)            // ProcessDescriptor.pid
+	writeLenDelimField(&desc, 3, process.Bytes()) // TrackDescriptor.process
+
+	writeLenDelimField(&p.buf, 60, desc.Bytes()) // TracePacket.track_descriptor
+	return p
+}
+
+// newPerfettoCounterTrackDescriptor declares a named counter track nested
+// under the process track parentUUID, so each key of a "C" event's Args map
+// gets its own load graph instead of sharing one untitled track.
+func newPerfettoCounterTrackDescriptor(uuid, parentUUID uint64, name string) *perfettoTracePacket {
+	p := &perfettoTracePacket{}
+	writeVarintField(&p.buf, 10, perfettoTrustedPacketSequenceID)
+
+	var desc bytes.Buffer
+	writeVarintField(&desc, 1, uuid)       // TrackDescriptor.uuid
+	writeStringField(&desc, 2, name)       // TrackDescriptor.name
+	writeVarintField(&desc, 5, parentUUID) // TrackDescriptor.parent_uuid
+
+	writeLenDelimField(&p.buf, 60, desc.Bytes()) // TracePacket.track_descriptor
+	return p
+}
+
+func newPerfettoThreadDescriptor(uuid, parentUUID, tid uint64) *perfettoTracePacket {
+	p := &perfettoTracePacket{}
+	writeVarintField(&p.buf, 10, perfettoTrustedPacketSequenceID)
+
+	var desc bytes.Buffer
+	writeVarintField(&desc, 1, uuid)       // TrackDescriptor.uuid
+	writeVarintField(&desc, 5, parentUUID) // TrackDescriptor.parent_uuid
+
+	// ThreadDescriptor.pid is left unset: the process is already conveyed by
+	// parent_uuid pointing at the ProcessDescriptor track, and we have no tid
+	// <-> pid mapping of our own to fill it in with.
+	var thread bytes.Buffer
+	writeVarintField(&thread, 2, tid)            // ThreadDescriptor.tid
+	writeLenDelimField(&desc, 4, thread.Bytes()) // TrackDescriptor.thread
+
+	writeLenDelimField(&p.buf, 60, desc.Bytes()) // TracePacket.track_descriptor
+	return p
+}
+
+// --- minimal protobuf wire-format helpers ---
+//
+// These cover only what TracePacket/TrackEvent/TrackDescriptor need: varint,
+// length-delimited, and fixed64 (double) fields. They exist so this package
+// doesn't have to take on a generated-code or protobuf-runtime dependency
+// just to write a handful of well-known message shapes.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func writeTag(buf *bytes.Buffer, field int, wireType int) {
+	writeVarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+func writeVarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	buf.Write(tmp[:n])
+}
+
+func writeVarintField(buf *bytes.Buffer, field int, v uint64) {
+	writeTag(buf, field, wireVarint)
+	writeVarint(buf, v)
+}
+
+func writeStringField(buf *bytes.Buffer, field int, s string) {
+	writeLenDelimField(buf, field, []byte(s))
+}
+
+func writeLenDelimField(buf *bytes.Buffer, field int, data []byte) {
+	writeTag(buf, field, wireBytes)
+	writeVarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func writeDoubleField(buf *bytes.Buffer, field int, v float64) {
+	writeTag(buf, field, wireFixed64)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+	buf.Write(tmp[:])
+}
+
+// writeLenDelim writes data to w prefixed with its own varint length, which
+// is how Perfetto trace files concatenate a stream of TracePackets.
+func writeLenDelim(w io.Writer, data []byte) error {
+	var lenBuf bytes.Buffer
+	writeVarint(&lenBuf, uint64(len(data)))
+	if _, err := w.Write(lenBuf.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,218 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// protoField is one decoded top-level field of a protobuf message, as
+// written by the writeVarintField/writeLenDelimField/writeDoubleField
+// helpers in perfetto.go. It's just enough of a decoder to assert on the
+// field numbers and values those helpers produce - not a general-purpose
+// protobuf reader.
+type protoField struct {
+	num  int
+	wire int
+	v    uint64
+	data []byte
+}
+
+func decodeProtoFields(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid tag varint in %x", b)
+		}
+		b = b[n:]
+		field := protoField{num: int(tag >> 3), wire: int(tag & 0x7)}
+		switch field.wire {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("invalid varint field %d in %x", field.num, b)
+			}
+			field.v = v
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				t.Fatalf("truncated fixed64 field %d", field.num)
+			}
+			field.v = binary.LittleEndian.Uint64(b[:8])
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("invalid length varint for field %d", field.num)
+			}
+			b = b[n:]
+			if uint64(len(b)) < l {
+				t.Fatalf("truncated length-delimited field %d", field.num)
+			}
+			field.data = b[:l]
+			b = b[l:]
+		default:
+			t.Fatalf("unsupported wire type %d for field %d", field.wire, field.num)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func findProtoField(fields []protoField, num int) (protoField, bool) {
+	for _, f := range fields {
+		if f.num == num {
+			return f, true
+		}
+	}
+	return protoField{}, false
+}
+
+func TestNewPerfettoThreadDescriptorFieldNumbers(t *testing.T) {
+	packet := newPerfettoThreadDescriptor(42, 7, 99)
+
+	descField, ok := findProtoField(decodeProtoFields(t, packet.buf.Bytes()), 60) // TracePacket.track_descriptor
+	if !ok {
+		t.Fatal("missing TracePacket.track_descriptor (field 60)")
+	}
+	desc := decodeProtoFields(t, descField.data)
+
+	if uuid, ok := findProtoField(desc, 1); !ok || uuid.v != 42 {
+		t.Errorf("TrackDescriptor.uuid (field 1) = %v, ok=%v, want 42", uuid.v, ok)
+	}
+	if parent, ok := findProtoField(desc, 5); !ok || parent.v != 7 {
+		t.Errorf("TrackDescriptor.parent_uuid (field 5) = %v, ok=%v, want 7", parent.v, ok)
+	}
+
+	threadField, ok := findProtoField(desc, 4) // TrackDescriptor.thread
+	if !ok {
+		t.Fatal("missing TrackDescriptor.thread (field 4)")
+	}
+	thread := decodeProtoFields(t, threadField.data)
+
+	// Regression check for the bug where tid was written into field 1
+	// (ThreadDescriptor.pid) instead of field 2 (ThreadDescriptor.tid).
+	if _, ok := findProtoField(thread, 1); ok {
+		t.Errorf("ThreadDescriptor.pid (field 1) is set, want unset")
+	}
+	if tid, ok := findProtoField(thread, 2); !ok || tid.v != 99 {
+		t.Errorf("ThreadDescriptor.tid (field 2) = %v, ok=%v, want 99", tid.v, ok)
+	}
+}
+
+func TestNewPerfettoProcessDescriptorFieldNumbers(t *testing.T) {
+	packet := newPerfettoProcessDescriptor(42, 7)
+
+	descField, ok := findProtoField(decodeProtoFields(t, packet.buf.Bytes()), 60)
+	if !ok {
+		t.Fatal("missing TracePacket.track_descriptor (field 60)")
+	}
+	desc := decodeProtoFields(t, descField.data)
+
+	if uuid, ok := findProtoField(desc, 1); !ok || uuid.v != 42 {
+		t.Errorf("TrackDescriptor.uuid (field 1) = %v, ok=%v, want 42", uuid.v, ok)
+	}
+
+	processField, ok := findProtoField(desc, 3) // TrackDescriptor.process
+	if !ok {
+		t.Fatal("missing TrackDescriptor.process (field 3)")
+	}
+	process := decodeProtoFields(t, processField.data)
+	if pid, ok := findProtoField(process, 1); !ok || pid.v != 7 {
+		t.Errorf("ProcessDescriptor.pid (field 1) = %v, ok=%v, want 7", pid.v, ok)
+	}
+}
+
+// TestWriteViewerEventCounterTracks checks that two distinct counter names
+// in the same "C" event's Args land on two distinct, separately named
+// tracks instead of being interleaved onto one.
+func TestWriteViewerEventCounterTracks(t *testing.T) {
+	var buf bytes.Buffer
+	w := newPerfettoWriter(&buf)
+
+	event := &viewerEvent{
+		Phase: "C",
+		Time:  1000,
+		Pid:   1,
+		Args: map[string]interface{}{
+			"running_jobs":  5,
+			"weighted_load": 2.5,
+		},
+	}
+	if err := w.WriteViewerEvent(event); err != nil {
+		t.Fatalf("WriteViewerEvent: %v", err)
+	}
+
+	jobsUUID := counterTrackUUID(1, "running_jobs")
+	loadUUID := counterTrackUUID(1, "weighted_load")
+	if jobsUUID == loadUUID {
+		t.Fatalf("counterTrackUUID collision between running_jobs and weighted_load: %d", jobsUUID)
+	}
+
+	packets := readLenDelimPackets(t, buf.Bytes())
+
+	names := map[uint64]string{}
+	trackEventUUIDs := map[uint64]bool{}
+	for _, packet := range packets {
+		fields := decodeProtoFields(t, packet)
+		if descField, ok := findProtoField(fields, 60); ok {
+			desc := decodeProtoFields(t, descField.data)
+			uuidField, _ := findProtoField(desc, 1)
+			if nameField, ok := findProtoField(desc, 2); ok {
+				names[uuidField.v] = string(nameField.data)
+			}
+		}
+		if eventField, ok := findProtoField(fields, 11); ok {
+			trackEvent := decodeProtoFields(t, eventField.data)
+			if uuidField, ok := findProtoField(trackEvent, 11); ok {
+				trackEventUUIDs[uuidField.v] = true
+			}
+		}
+	}
+
+	if names[jobsUUID] != "running_jobs" {
+		t.Errorf("track %d name = %q, want running_jobs", jobsUUID, names[jobsUUID])
+	}
+	if names[loadUUID] != "weighted_load" {
+		t.Errorf("track %d name = %q, want weighted_load", loadUUID, names[loadUUID])
+	}
+	if !trackEventUUIDs[jobsUUID] || !trackEventUUIDs[loadUUID] {
+		t.Errorf("expected TrackEvents on both %d and %d, got %v", jobsUUID, loadUUID, trackEventUUIDs)
+	}
+}
+
+// readLenDelimPackets splits a stream of writeLenDelim-framed packets back
+// into their raw bytes.
+func readLenDelimPackets(t *testing.T, b []byte) [][]byte {
+	t.Helper()
+	var packets [][]byte
+	for len(b) > 0 {
+		l, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid packet length varint in %x", b)
+		}
+		b = b[n:]
+		if uint64(len(b)) < l {
+			t.Fatalf("truncated packet, want %d bytes, have %d", l, len(b))
+		}
+		packets = append(packets, b[:l])
+		b = b[l:]
+	}
+	return packets
+}